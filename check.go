@@ -0,0 +1,111 @@
+// vim:set ts=2 sw=2 et ai ft=go:
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "syscall"
+)
+
+// Run the check subcommand. args are whatever followed "check" on the command
+// line; flags are accepted there as well as before it. Returns the process
+// exit status: 0 if the configuration checked out, 1 if problems were found
+// and 2 for a usage error.
+func checkCommand(fs *flag.FlagSet, args []string) int {
+  if err := fs.Parse(args); err != nil {
+    return 2
+  }
+  if fs.NArg() > 0 {
+    fmt.Fprintf(os.Stderr, "check: unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+    return 2
+  }
+  return check()
+}
+
+// Validate the startup configuration without serving any traffic. Problems
+// (including bad log file settings) are reported on stderr and make the check
+// fail. An address that is already in use is only a warning, since during a
+// deploy the running instance will normally still be holding it.
+func check() int {
+  var problems []string
+  // An empty host means all interfaces, so there is nothing to resolve.
+  if host != "" {
+    if _, err := net.LookupHost(host); err != nil {
+      problems = append(problems, fmt.Sprintf("cannot resolve host %q: %v", host, err))
+    }
+  }
+  if port < 1 || port > 65535 {
+    problems = append(problems, fmt.Sprintf("port %d out of range (1-65535)", port))
+  }
+  if len(problems) == 0 {
+    addr := net.JoinHostPort(host, strconv.Itoa(port))
+    l, err := net.Listen("tcp", addr)
+    switch {
+    case err == nil:
+      l.Close()
+    case errors.Is(err, syscall.EADDRINUSE):
+      fmt.Fprintf(os.Stderr, "check: warning: %s already in use (fine if this is the running instance)\n", addr)
+    default:
+      problems = append(problems, fmt.Sprintf("cannot listen on %s: %v", addr, err))
+    }
+  }
+  problems = append(problems, checkLog()...)
+  return report(problems)
+}
+
+// Validate the log flags and make sure the log file can be opened the same way
+// the server would open it. If that creates the file, it is removed again.
+func checkLog() []string {
+  problems := checkLogFlags()
+  if logfile == "" {
+    return problems
+  }
+  _, err := os.Stat(logfile)
+  existed := err == nil
+  f, _, err := openAppend(logfile)
+  if err != nil {
+    return append(problems, fmt.Sprintf("cannot open log file: %v", err))
+  }
+  f.Close()
+  if !existed {
+    os.Remove(logfile)
+  }
+  return problems
+}
+
+// Reject log settings that make no sense. The server refuses to start with
+// them, too.
+func checkLogFlags() []string {
+  var problems []string
+  if _, err := parseLevel(loglevel); err != nil {
+    problems = append(problems, err.Error())
+  }
+  if logsize < 0 {
+    problems = append(problems, fmt.Sprintf("logsize %d is negative", logsize))
+  }
+  if logage < 0 {
+    problems = append(problems, fmt.Sprintf("logage %v is negative", logage))
+  }
+  if logkeep < 0 {
+    problems = append(problems, fmt.Sprintf("logkeep %d is negative", logkeep))
+  }
+  return problems
+}
+
+// Print problems found by check and return the matching exit status.
+func report(problems []string) int {
+  if len(problems) == 0 {
+    fmt.Fprintln(os.Stderr, "check: ok")
+    return 0
+  }
+  for _, p := range problems {
+    fmt.Fprintf(os.Stderr, "check: %s\n", p)
+  }
+  fmt.Fprintf(os.Stderr, "check: %d problem(s) found\n", len(problems))
+  return 1
+}
@@ -0,0 +1,145 @@
+// vim:set ts=2 sw=2 et ai ft=go:
+package main
+
+import (
+  "flag"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// Point the listen flags at the given values for the duration of a test.
+func setListen(t *testing.T, h string, p int) {
+  oh, op := host, port
+  host, port = h, p
+  t.Cleanup(func() { host, port = oh, op })
+}
+
+func freePort(t *testing.T) int {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  return l.Addr().(*net.TCPAddr).Port
+}
+
+func checkFlags() *flag.FlagSet {
+  fs := flag.NewFlagSet("check", flag.ContinueOnError)
+  fs.SetOutput(ioutil.Discard)
+  fs.StringVar(&host, "host", host, "")
+  fs.IntVar(&port, "port", port, "")
+  return fs
+}
+
+func TestCheckPortOutOfRange(t *testing.T) {
+  for _, p := range []int{0, -1, 65536, 70000} {
+    setListen(t, "127.0.0.1", p)
+    if rc := check(); rc != 1 {
+      t.Errorf("port %d: got exit %d, want 1", p, rc)
+    }
+  }
+}
+
+func TestCheckBindable(t *testing.T) {
+  setListen(t, "127.0.0.1", freePort(t))
+  if rc := check(); rc != 0 {
+    t.Errorf("got exit %d, want 0", rc)
+  }
+}
+
+func TestCheckAddressInUse(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  setListen(t, "127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+  if rc := check(); rc != 0 {
+    t.Errorf("got exit %d, want 0 for an address held by a running instance", rc)
+  }
+}
+
+func TestCheckAllInterfaces(t *testing.T) {
+  setListen(t, "", freePort(t))
+  if rc := check(); rc != 0 {
+    t.Errorf("got exit %d, want 0 for an empty host", rc)
+  }
+}
+
+func TestCheckUnresolvableHost(t *testing.T) {
+  setListen(t, "no-such-host.invalid", freePort(t))
+  if rc := check(); rc != 1 {
+    t.Errorf("got exit %d, want 1", rc)
+  }
+}
+
+func TestCheckCommandFlagsAfterCheck(t *testing.T) {
+  setListen(t, "127.0.0.1", freePort(t))
+  if rc := checkCommand(checkFlags(), []string{"-port", "70000"}); rc != 1 {
+    t.Errorf("got exit %d, want 1", rc)
+  }
+  if port != 70000 {
+    t.Errorf("port = %d, want 70000", port)
+  }
+}
+
+func TestCheckCommandBadArgs(t *testing.T) {
+  setListen(t, "127.0.0.1", freePort(t))
+  if rc := checkCommand(checkFlags(), []string{"extra"}); rc != 2 {
+    t.Errorf("extra argument: got exit %d, want 2", rc)
+  }
+  if rc := checkCommand(checkFlags(), []string{"-nosuchflag"}); rc != 2 {
+    t.Errorf("unknown flag: got exit %d, want 2", rc)
+  }
+}
+
+// Point the log flags at the given values for the duration of a test.
+func setLog(t *testing.T, file string, size int64, age time.Duration, keep int) {
+  of, osz, oa, ok := logfile, logsize, logage, logkeep
+  logfile, logsize, logage, logkeep = file, size, age, keep
+  t.Cleanup(func() { logfile, logsize, logage, logkeep = of, osz, oa, ok })
+}
+
+func TestCheckLogFile(t *testing.T) {
+  setListen(t, "127.0.0.1", freePort(t))
+  dir := t.TempDir()
+  tests := []struct {
+    file string
+    size int64
+    age  time.Duration
+    keep int
+    want int
+  }{
+    {"", 100, time.Hour, 7, 0},
+    {filepath.Join(dir, "app.log"), 100, time.Hour, 7, 0},
+    {filepath.Join(dir, "missing", "app.log"), 100, time.Hour, 7, 1},
+    {"", -1, time.Hour, 7, 1},
+    {"", 100, -time.Hour, 7, 1},
+    {"", 100, time.Hour, -1, 1},
+  }
+  for _, tt := range tests {
+    setLog(t, tt.file, tt.size, tt.age, tt.keep)
+    if rc := check(); rc != tt.want {
+      t.Errorf("%+v: got exit %d, want %d", tt, rc, tt.want)
+    }
+  }
+  if _, err := os.Stat(filepath.Join(dir, "app.log")); !os.IsNotExist(err) {
+    t.Errorf("check left the log file it created behind: %v", err)
+  }
+}
+
+func TestCheckLogLevel(t *testing.T) {
+  setListen(t, "127.0.0.1", freePort(t))
+  old := loglevel
+  t.Cleanup(func() { loglevel = old })
+  for name, want := range map[string]int{"debug": 0, "INFO": 0, "warn": 0, "critical": 0, "verbose": 1, "": 1} {
+    loglevel = name
+    if rc := check(); rc != want {
+      t.Errorf("loglevel %q: got exit %d, want %d", name, rc, want)
+    }
+  }
+}
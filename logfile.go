@@ -0,0 +1,238 @@
+// vim:set ts=2 sw=2 et ai ft=go:
+package main
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "os"
+  "os/signal"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// Rotated files are named <path>.<UTC timestamp>, plus .gz once compressed.
+// The layout is fixed-width so that names sort in rotation order.
+const backupLayout = "20060102T150405.000000000Z"
+
+// A log file that rotates itself once it grows past maxSize bytes or has been
+// open longer than maxAge. Rotated files are gzipped next to the original and
+// only the newest keep of them are retained. A zero maxSize or maxAge disables
+// that trigger.
+type logFile struct {
+  mu      sync.Mutex
+  path    string
+  maxSize int64
+  maxAge  time.Duration
+  keep    int
+  f       *os.File
+  size    int64
+  opened  time.Time
+  last    time.Time      // timestamp of the newest backup name handed out
+  zmu     sync.Mutex     // serializes compress and prune
+  bg      sync.WaitGroup // outstanding compress goroutines
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*logFile, error) {
+  l := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+  f, size, err := openAppend(path)
+  if err != nil {
+    return nil, err
+  }
+  l.f, l.size, l.opened = f, size, l.started(size)
+  return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.due(int64(len(p))) {
+    l.rotate()
+  }
+  n, err := l.f.Write(p)
+  l.size += int64(n)
+  return n, err
+}
+
+// Reopen the log file at the same path. This is what external tools that move
+// the file out of the way expect on SIGHUP. If the path cannot be opened the
+// current file is kept.
+func (l *logFile) Reopen() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return l.reopen()
+}
+
+// Reopen l whenever the process receives SIGHUP, until the returned function
+// is called.
+func reopenOnHangup(l *logFile) (stop func()) {
+  c := make(chan os.Signal, 1)
+  signal.Notify(c, syscall.SIGHUP)
+  go func() {
+    for range c {
+      if err := l.Reopen(); err != nil {
+        fmt.Fprintf(os.Stderr, "cannot reopen log file: %v\n", err)
+      }
+    }
+  }()
+  return func() {
+    signal.Stop(c)
+    close(c)
+  }
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, 0, err
+  }
+  fi, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, 0, err
+  }
+  return f, fi.Size(), nil
+}
+
+// Swap in a freshly opened file at l.path. The old file is only closed once
+// the new one is ready, so on failure l keeps writing where it was.
+func (l *logFile) reopen() error {
+  f, size, err := openAppend(l.path)
+  if err != nil {
+    return err
+  }
+  l.f.Close()
+  l.f, l.size, l.opened = f, size, l.started(size)
+  return nil
+}
+
+// When the current file was started, for the age trigger, so that restarting
+// the process doesn't reset the clock. A non-empty file was started by the
+// most recent rotation; if there is no backup to say when that was, its age is
+// unknown and it is treated as due.
+func (l *logFile) started(size int64) time.Time {
+  if size == 0 {
+    return time.Now()
+  }
+  _, stamps := l.rotated()
+  if len(stamps) == 0 {
+    return time.Time{}
+  }
+  t, _ := time.Parse(backupLayout, stamps[len(stamps)-1])
+  return t
+}
+
+func (l *logFile) due(n int64) bool {
+  if l.maxSize > 0 && l.size > 0 && l.size+n > l.maxSize {
+    return true
+  }
+  return l.maxAge > 0 && time.Since(l.opened) >= l.maxAge
+}
+
+// Move the current file aside and start a new one. Failures are reported on
+// stderr rather than returned: whatever happens, l is left with an open file
+// and a fresh size and age, so a failed rotation is not retried on every
+// write.
+func (l *logFile) rotate() {
+  name := l.backupName()
+  if err := os.Rename(l.path, name); err != nil {
+    // Most likely the file was moved away without a SIGHUP; start a new
+    // one at the path.
+    fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+    name = ""
+  }
+  if err := l.reopen(); err != nil {
+    fmt.Fprintf(os.Stderr, "log rotation: %v\n", err)
+    if name != "" {
+      // Still writing to the renamed file, so put it back.
+      os.Rename(name, l.path)
+    }
+    l.size, l.opened = 0, time.Now()
+    return
+  }
+  if name != "" {
+    l.bg.Add(1)
+    go l.compress(name)
+  }
+}
+
+// Pick a backup name that no other rotation in this process has used.
+func (l *logFile) backupName() string {
+  t := time.Now().UTC()
+  if !t.After(l.last) {
+    t = l.last.Add(time.Nanosecond)
+  }
+  l.last = t
+  return l.path + "." + t.Format(backupLayout)
+}
+
+// Gzip a rotated log file in place and prune old backups.
+func (l *logFile) compress(name string) {
+  defer l.bg.Done()
+  l.zmu.Lock()
+  defer l.zmu.Unlock()
+  defer l.prune()
+  in, err := os.Open(name)
+  if err != nil {
+    return
+  }
+  defer in.Close()
+  out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+  if err != nil {
+    return
+  }
+  gz := gzip.NewWriter(out)
+  _, err = io.Copy(gz, in)
+  if cerr := gz.Close(); err == nil {
+    err = cerr
+  }
+  if cerr := out.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    os.Remove(name + ".gz")
+    return
+  }
+  os.Remove(name)
+}
+
+// Remove all but the newest keep backups. Uncompressed backups left behind by
+// a crash or a failed compress count towards the limit too.
+func (l *logFile) prune() {
+  if l.keep <= 0 {
+    return
+  }
+  files, stamps := l.rotated()
+  if len(stamps) <= l.keep {
+    return
+  }
+  for _, stamp := range stamps[:len(stamps)-l.keep] {
+    for _, name := range files[stamp] {
+      os.Remove(name)
+    }
+  }
+}
+
+// The backups of l, compressed or not, grouped by timestamp, along with the
+// timestamps oldest first.
+func (l *logFile) rotated() (map[string][]string, []string) {
+  files := make(map[string][]string)
+  var stamps []string
+  matches, _ := filepath.Glob(l.path + ".*")
+  for _, name := range matches {
+    stamp := strings.TrimSuffix(strings.TrimPrefix(name, l.path+"."), ".gz")
+    if _, err := time.Parse(backupLayout, stamp); err != nil {
+      continue
+    }
+    if files[stamp] == nil {
+      stamps = append(stamps, stamp)
+    }
+    files[stamp] = append(files[stamp], name)
+  }
+  sort.Strings(stamps)
+  return files, stamps
+}
@@ -0,0 +1,286 @@
+// vim:set ts=2 sw=2 et ai ft=go:
+package main
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "syscall"
+  "testing"
+  "time"
+)
+
+func newLogFile(t *testing.T, maxSize int64, maxAge time.Duration, keep int) (*logFile, string) {
+  path := filepath.Join(t.TempDir(), "app.log")
+  l, err := openLogFile(path, maxSize, maxAge, keep)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    l.bg.Wait()
+    l.f.Close()
+  })
+  return l, path
+}
+
+func writeLine(t *testing.T, l *logFile, s string) {
+  if _, err := fmt.Fprintln(l, s); err != nil {
+    t.Fatalf("write %q: %v", s, err)
+  }
+}
+
+func readFile(t *testing.T, path string) string {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(b)
+}
+
+func readGzip(t *testing.T, path string) string {
+  f, err := os.Open(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  gz, err := gzip.NewReader(f)
+  if err != nil {
+    t.Fatal(err)
+  }
+  b, err := ioutil.ReadAll(gz)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(b)
+}
+
+// Backups of path, oldest first.
+func backups(t *testing.T, path string) []string {
+  names, err := filepath.Glob(path + ".*")
+  if err != nil {
+    t.Fatal(err)
+  }
+  sort.Strings(names)
+  return names
+}
+
+func TestLogFileRotatesOnSize(t *testing.T) {
+  l, path := newLogFile(t, 10, 0, 0)
+  writeLine(t, l, "first")
+  writeLine(t, l, "second")
+  l.bg.Wait()
+  if got := readFile(t, path); got != "second\n" {
+    t.Errorf("current log = %q, want %q", got, "second\n")
+  }
+  b := backups(t, path)
+  if len(b) != 1 || filepath.Ext(b[0]) != ".gz" {
+    t.Fatalf("backups = %v, want one .gz", b)
+  }
+  if got := readGzip(t, b[0]); got != "first\n" {
+    t.Errorf("backup = %q, want %q", got, "first\n")
+  }
+}
+
+func TestLogFileRotatesOnAge(t *testing.T) {
+  l, path := newLogFile(t, 0, time.Hour, 0)
+  writeLine(t, l, "old")
+  writeLine(t, l, "still old")
+  if b := backups(t, path); len(b) != 0 {
+    t.Fatalf("rotated too early: %v", b)
+  }
+  l.opened = l.opened.Add(-time.Hour)
+  writeLine(t, l, "new")
+  l.bg.Wait()
+  if got := readFile(t, path); got != "new\n" {
+    t.Errorf("current log = %q, want %q", got, "new\n")
+  }
+  if b := backups(t, path); len(b) != 1 {
+    t.Errorf("backups = %v, want 1", b)
+  }
+}
+
+// Restarting must not reset the age of a file that is being appended to.
+func TestLogFileAgeSurvivesRestart(t *testing.T) {
+  dir := t.TempDir()
+  tests := []struct {
+    name    string
+    content string
+    backup  time.Duration // age of the newest backup; 0 for none
+    rotate  bool
+  }{
+    {"empty file", "", 0, false},
+    {"recent backup", "old\n", 10 * time.Minute, false},
+    {"old backup", "old\n", 2 * time.Hour, true},
+    {"no backup", "old\n", 0, true},
+  }
+  for i, tt := range tests {
+    path := filepath.Join(dir, fmt.Sprintf("app%d.log", i))
+    if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+      t.Fatal(err)
+    }
+    if tt.backup > 0 {
+      name := path + "." + time.Now().Add(-tt.backup).UTC().Format(backupLayout) + ".gz"
+      if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+        t.Fatal(err)
+      }
+    }
+    l, err := openLogFile(path, 0, time.Hour, 0)
+    if err != nil {
+      t.Fatal(err)
+    }
+    writeLine(t, l, "new")
+    l.bg.Wait()
+    l.f.Close()
+    want := tt.content + "new\n"
+    if tt.rotate {
+      want = "new\n"
+    }
+    if got := readFile(t, path); got != want {
+      t.Errorf("%s: current log = %q, want %q", tt.name, got, want)
+    }
+  }
+}
+
+func TestLogFileKeepsNewestBackups(t *testing.T) {
+  l, path := newLogFile(t, 1, 0, 2)
+  // Unrelated files next to the log must be left alone.
+  other := path + ".notes.gz"
+  if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  // An uncompressed backup left behind by a crash counts towards the limit.
+  stale := path + "." + time.Unix(0, 0).UTC().Format(backupLayout)
+  if err := ioutil.WriteFile(stale, []byte("stale\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 5; i++ {
+    writeLine(t, l, fmt.Sprint(i))
+    l.bg.Wait()
+  }
+  if _, err := os.Stat(other); err != nil {
+    t.Errorf("unrelated file removed: %v", err)
+  }
+  if _, err := os.Stat(stale); !os.IsNotExist(err) {
+    t.Errorf("stale backup not pruned: %v", err)
+  }
+  var kept []string
+  for _, name := range backups(t, path) {
+    if name != other {
+      kept = append(kept, readGzip(t, name))
+    }
+  }
+  if len(kept) != 2 || kept[0] != "2\n" || kept[1] != "3\n" {
+    t.Errorf("kept backups = %q, want [\"2\\n\" \"3\\n\"]", kept)
+  }
+}
+
+func TestLogFileBackupNamesUnique(t *testing.T) {
+  l, _ := newLogFile(t, 0, 0, 0)
+  seen := make(map[string]bool)
+  prev := ""
+  for i := 0; i < 1000; i++ {
+    name := l.backupName()
+    if seen[name] {
+      t.Fatalf("duplicate backup name %s", name)
+    }
+    if name <= prev {
+      t.Fatalf("backup name %s does not sort after %s", name, prev)
+    }
+    seen[name] = true
+    prev = name
+  }
+}
+
+func TestLogFileReopen(t *testing.T) {
+  l, path := newLogFile(t, 0, 0, 0)
+  writeLine(t, l, "before")
+  moved := path + ".moved"
+  if err := os.Rename(path, moved); err != nil {
+    t.Fatal(err)
+  }
+  if err := l.Reopen(); err != nil {
+    t.Fatal(err)
+  }
+  writeLine(t, l, "after")
+  if got := readFile(t, moved); got != "before\n" {
+    t.Errorf("moved log = %q, want %q", got, "before\n")
+  }
+  if got := readFile(t, path); got != "after\n" {
+    t.Errorf("new log = %q, want %q", got, "after\n")
+  }
+}
+
+func TestLogFileReopenFailureKeepsWriting(t *testing.T) {
+  l, path := newLogFile(t, 0, 0, 0)
+  dir := filepath.Dir(path)
+  moved := filepath.Join(t.TempDir(), "moved")
+  if err := os.Rename(dir, moved); err != nil {
+    t.Fatal(err)
+  }
+  if err := l.Reopen(); err == nil {
+    t.Fatal("Reopen succeeded with the directory gone")
+  }
+  writeLine(t, l, "still here")
+  if got := readFile(t, filepath.Join(moved, "app.log")); got != "still here\n" {
+    t.Errorf("log = %q, want %q", got, "still here\n")
+  }
+  os.Rename(moved, dir)
+}
+
+func TestLogFileReopenOnHangup(t *testing.T) {
+  l, path := newLogFile(t, 0, 0, 0)
+  t.Cleanup(reopenOnHangup(l))
+  if err := os.Rename(path, path+".moved"); err != nil {
+    t.Fatal(err)
+  }
+  if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+    t.Fatal(err)
+  }
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    if _, err := os.Stat(path); err == nil {
+      break
+    }
+    if time.Now().After(deadline) {
+      t.Fatal("log file not reopened after SIGHUP")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  writeLine(t, l, "after")
+  if got := readFile(t, path); got != "after\n" {
+    t.Errorf("new log = %q, want %q", got, "after\n")
+  }
+}
+
+// Moving the file away without a SIGHUP makes the rotation's rename fail; the
+// writer must carry on with a new file at the path rather than getting stuck.
+func TestLogFileRotateAfterFileMovedAway(t *testing.T) {
+  l, path := newLogFile(t, 10, 0, 0)
+  writeLine(t, l, "first")
+  if err := os.Rename(path, path+".moved"); err != nil {
+    t.Fatal(err)
+  }
+  for _, s := range []string{"second", "third", "fourth"} {
+    writeLine(t, l, s)
+  }
+  l.bg.Wait()
+  if _, err := os.Stat(path); err != nil {
+    t.Fatalf("no log file at path after failed rotation: %v", err)
+  }
+  if got := readFile(t, path+".moved"); got != "first\n" {
+    t.Errorf("moved log = %q, want %q", got, "first\n")
+  }
+  var all string
+  for _, name := range backups(t, path) {
+    if filepath.Ext(name) == ".gz" {
+      all += readGzip(t, name)
+    }
+  }
+  all += readFile(t, path)
+  if all != "second\nthird\nfourth\n" {
+    t.Errorf("logged after move = %q, want %q", all, "second\nthird\nfourth\n")
+  }
+}
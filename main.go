@@ -5,25 +5,88 @@ import (
   "github.com/codeslinger/log"
   "github.com/codeslinger/webapp"
   "flag"
+  "fmt"
+  "io"
   "os"
   "runtime"
+  "strings"
+  "time"
 )
 
 var (
-  host string
-  port int
+  host     string
+  port     int
+  loglevel string
+  logfile  string
+  logsize  int64
+  logage   time.Duration
+  logkeep  int
 )
 
+// Names accepted by -loglevel.
+var logLevels = map[string]log.Level{
+  "debug":    log.DEBUG,
+  "info":     log.INFO,
+  "warn":     log.WARN,
+  "critical": log.CRITICAL,
+}
+
 func init() {
   flag.StringVar(&host, "host", "127.0.0.1", "host address on which to listen")
   flag.IntVar(&port, "port", 9999, "port on which to listen")
+  flag.StringVar(&loglevel, "loglevel", "info", "minimum level to log (debug, info, warn or critical)")
+  flag.StringVar(&logfile, "logfile", "", "file to log to instead of stdout")
+  flag.Int64Var(&logsize, "logsize", 100, "rotate log file after this many megabytes (0 to disable)")
+  flag.DurationVar(&logage, "logage", 24*time.Hour, "rotate log file after this long (0 to disable)")
+  flag.IntVar(&logkeep, "logkeep", 7, "number of rotated log files to keep (0 to keep all)")
+  flag.Usage = usage
+}
+
+func usage() {
+  fmt.Fprintf(os.Stderr, "usage: %s [flags] [check [flags]]\n\n", os.Args[0])
+  fmt.Fprintln(os.Stderr, "  check: validate the configuration and exit instead of serving")
+  fmt.Fprintln(os.Stderr)
+  flag.PrintDefaults()
+}
+
+func parseLevel(name string) (log.Level, error) {
+  level, ok := logLevels[strings.ToLower(name)]
+  if !ok {
+    return level, fmt.Errorf("unknown log level %q (want debug, info, warn or critical)", name)
+  }
+  return level, nil
 }
 
 func main() {
   flag.Parse()
+  switch flag.Arg(0) {
+  case "":
+  case "check":
+    os.Exit(checkCommand(flag.CommandLine, flag.Args()[1:]))
+  default:
+    fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+    flag.Usage()
+    os.Exit(2)
+  }
+  if problems := checkLogFlags(); len(problems) > 0 {
+    for _, p := range problems {
+      fmt.Fprintln(os.Stderr, p)
+    }
+    os.Exit(1)
+  }
   runtime.GOMAXPROCS(runtime.NumCPU())
-  logger := log.NewLogger(os.Stdout, log.INFO)
+  var out io.Writer = os.Stdout
+  if logfile != "" {
+    lf, err := openLogFile(logfile, logsize<<20, logage, logkeep)
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "cannot open log file: %v\n", err)
+      os.Exit(1)
+    }
+    reopenOnHangup(lf)
+    out = lf
+  }
+  level, _ := parseLevel(loglevel)
+  logger := log.NewLogger(out, level)
   app := webapp.NewWebapp(host, port, logger)
   app.Run()
 }
-